@@ -0,0 +1,124 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestUpdateCarriesForwardUnchangedFilesAndPrunesRemoved(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "idx")
+	opt := &IndexOptions{}
+
+	ref, _, err := BuildFromZip(opt, buildZip(t, map[string]string{
+		"readme.txt": "hello world",
+		"keep.txt":   "unchanged content",
+		"gone.txt":   "will be removed",
+	}), dst, "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ref.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if _, _, err := n.Update(opt, buildZip(t, map[string]string{
+		"readme.txt": "hello world, updated",
+		"keep.txt":   "unchanged content",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := n.Ref.Fingerprints["gone.txt"]; ok {
+		t.Fatal("gone.txt should have been pruned from Fingerprints")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "raw", "gone.txt")); !os.IsNotExist(err) {
+		t.Fatalf("gone.txt raw blob should have been removed, stat err = %v", err)
+	}
+
+	for _, name := range []string{"readme.txt", "keep.txt"} {
+		if _, ok := n.Ref.Fingerprints[name]; !ok {
+			t.Fatalf("%s missing from Fingerprints after Update", name)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "raw", name)); err != nil {
+			t.Fatalf("%s raw blob missing after Update: %v", name, err)
+		}
+	}
+
+	if n.Ref.Fingerprints["keep.txt"] == n.Ref.Fingerprints["readme.txt"] {
+		t.Fatal("keep.txt and readme.txt have different content and should not carry equal fingerprints")
+	}
+
+	for _, staging := range []string{"tri.carried", "tri.delta", "tri.merged", "tri.bak"} {
+		if _, err := os.Stat(filepath.Join(dst, staging)); !os.IsNotExist(err) {
+			t.Fatalf("staging directory %s should not survive a successful Update, stat err = %v", staging, err)
+		}
+	}
+}
+
+func TestUpdateFailureLeavesLiveIndexIntact(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "idx")
+	opt := &IndexOptions{}
+
+	ref, _, err := BuildFromZip(opt, buildZip(t, map[string]string{
+		"a.txt": "alpha",
+	}), dst, "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ref.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// Force carryForwardFile to fail by removing the raw/ blob it needs to
+	// read back, simulating a transient failure partway through Update.
+	if err := os.Remove(filepath.Join(dst, "raw", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := n.Update(opt, buildZip(t, map[string]string{
+		"a.txt": "alpha",
+		"b.txt": "beta",
+	})); err == nil {
+		t.Fatal("expected Update to fail when a carried-forward raw/ blob is missing")
+	}
+
+	for _, staging := range []string{"tri.carried", "tri.delta", "tri.merged", "tri.bak"} {
+		if _, err := os.Stat(filepath.Join(dst, staging)); !os.IsNotExist(err) {
+			t.Fatalf("staging directory %s should not survive a failed Update, stat err = %v", staging, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "tri")); err != nil {
+		t.Fatalf("live tri/ index should still exist after a failed Update: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package index
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/gob"
@@ -10,10 +11,17 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
+	"github.com/spf13/afero"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+
 	"github.com/wpdirectory/wpdir/internal/codesearch/index"
 	"github.com/wpdirectory/wpdir/internal/codesearch/regexp"
 	"github.com/wpdirectory/wpdir/internal/filestats"
@@ -27,10 +35,16 @@ const (
 )
 
 const (
-	reasonDotFile     = "Dot files are excluded."
-	reasonInvalidMode = "Invalid file mode."
-	reasonNotText     = "Not a text file."
-	reasonBinary      = "Binary files are excluded."
+	reasonDotFile       = "Dot files are excluded."
+	reasonInvalidMode   = "Invalid file mode."
+	reasonNotText       = "Not a text file."
+	reasonBinary        = "Binary files are excluded."
+	reasonSymlink       = "Symlinks are excluded."
+	reasonDevice        = "Device files are excluded."
+	reasonPathTraversal = "Entry path escapes the archive root."
+	reasonTooLarge      = "File exceeds the configured maximum size."
+	reasonZipBomb       = "File's compression ratio exceeds the configured maximum."
+	reasonTotalTooLarge = "Archive's total uncompressed size exceeds the configured maximum."
 )
 
 type Index struct {
@@ -42,8 +56,65 @@ type Index struct {
 type IndexOptions struct {
 	ExcludeDotFiles bool
 	SpecialFiles    []string
+
+	// FallbackEncoding is the name of a legacy text encoding (e.g. "shift_jis",
+	// "euc-kr", "windows-1252", "iso-8859-1") to try when a file fails UTF-8
+	// validation, instead of excluding it outright. Empty disables fallback
+	// decoding and preserves the previous behavior of excluding the file with
+	// reasonNotText. Names are resolved via golang.org/x/text/encoding/htmlindex.
+	FallbackEncoding string
+
+	// FS is the filesystem the manifest, raw/ blobs, and excluded_files.json
+	// are written to and read from. Nil defaults to the OS filesystem.
+	// Callers can plug in an in-memory afero.Fs to keep unit tests off disk.
+	// Note this only covers that blob storage: the trigram index itself
+	// (the "tri" directory, and the "tri.carried"/"tri.delta"/"tri.merged"
+	// staging directories BuildFromZipIncremental uses) goes through the
+	// codesearch/index package directly and always lives on local disk, so
+	// FS alone doesn't make the whole index relocatable to e.g. S3/GCS.
+	FS afero.Fs
+
+	// MaxFileSize caps the uncompressed size of any single ZIP entry that
+	// will be indexed; larger entries are excluded instead of read. Zero
+	// disables the check.
+	MaxFileSize int64
+
+	// MaxTotalUncompressed caps the running total of uncompressed bytes
+	// admitted across an entire archive, guarding against a zip bomb that
+	// spreads its payload across many entries rather than one. Entries that
+	// would push the total over the cap are excluded. Zero disables the
+	// check.
+	MaxTotalUncompressed int64
+
+	// MaxCompressionRatio caps UncompressedSize64/CompressedSize64 for a
+	// single entry; entries above it look like zip bombs and are excluded
+	// before they're ever decompressed. Zero disables the check.
+	MaxCompressionRatio float64
+}
+
+// resolveFS returns fs, or an OS-backed afero.Fs if fs is nil.
+func resolveFS(fs afero.Fs) afero.Fs {
+	if fs == nil {
+		return afero.NewOsFs()
+	}
+	return fs
 }
 
+// OrderBy values for SearchOptions.OrderBy.
+const (
+	// OrderByFilename sorts candidate files ascending by name. This is the
+	// default (the zero value also selects it) and gives Search a stable,
+	// cheap-to-compute order that doesn't require opening any raw/ blobs.
+	OrderByFilename = "filename"
+
+	// OrderByMatchCount sorts candidate files by their indexed trigram count
+	// descending, as a proxy for how much matching content a file is likely
+	// to contain, breaking ties by filename. The ranking is read from
+	// IndexRef.TrigramCounts, so it's available before any raw/ blob is
+	// opened.
+	OrderByMatchCount = "matches"
+)
+
 type SearchOptions struct {
 	IgnoreCase     bool
 	LinesOfContext uint
@@ -51,6 +122,11 @@ type SearchOptions struct {
 	IgnoreComments bool
 	Offset         int
 	Limit          int
+
+	// OrderBy controls the order candidate files are scanned in, which in
+	// turn determines which files Offset/Limit select. See OrderByFilename
+	// and OrderByMatchCount. Empty defaults to OrderByFilename.
+	OrderBy string
 }
 
 type Match struct {
@@ -61,12 +137,21 @@ type Match struct {
 }
 
 type SearchResponse struct {
-	Matches        []*FileMatch
-	Slug           string
+	Matches []*FileMatch
+	Slug    string
+
+	// FilesWithMatch counts files that matched while Search was scanning.
+	// When SearchOptions.Limit is set, Search stops scanning once
+	// Offset+Limit matching files have been found, so FilesWithMatch is then
+	// a lower bound on the true number of matching files in the index, not
+	// an exhaustive count.
 	FilesWithMatch int
-	FilesOpened    int           `json:"-"`
-	Duration       time.Duration `json:"-"`
-	Revision       string
+
+	// FilesOpened counts raw/ blobs Search actually opened, for the same
+	// reason bounded by Limit rather than exhaustive.
+	FilesOpened int           `json:"-"`
+	Duration    time.Duration `json:"-"`
+	Revision    string
 }
 
 type FileMatch struct {
@@ -79,10 +164,41 @@ type ExcludedFile struct {
 	Reason   string
 }
 
+// fileFingerprint identifies a ZIP entry's content cheaply via the CRC32 and
+// size recorded in its central directory entry, without needing to
+// decompress it. Two builds of the same file produce an equal fingerprint
+// unless the content actually changed.
+type fileFingerprint struct {
+	CRC32 uint32
+	Size  uint64
+}
+
 type IndexRef struct {
 	Time time.Time
 	dir  string
 	Slug string
+
+	// FallbackEncoding is the legacy encoding (if any) that was configured via
+	// IndexOptions.FallbackEncoding when this index was built. It is recorded
+	// here so that the choice survives a Read/Open round trip.
+	FallbackEncoding string
+
+	// Fingerprints records the CRC32/size of every file that was indexed in
+	// this build, keyed by name. BuildFromZipIncremental and Index.Update use
+	// this to tell which files in a later archive actually changed, so they
+	// can skip re-tokenizing and re-compressing the rest.
+	Fingerprints map[string]fileFingerprint
+
+	// TrigramCounts records the number of distinct trigrams in each indexed
+	// file, keyed by name. It persists alongside the manifest so Search can
+	// rank candidates under OrderByMatchCount without decompressing raw/
+	// blobs just to estimate how much matching content they hold.
+	TrigramCounts map[string]int
+
+	// fs is the filesystem dir lives on. Like dir, it is set by whichever of
+	// Read/Open/BuildFromZipReader produced this ref and is not persisted to
+	// the manifest.
+	fs afero.Fs
 }
 
 func (r *IndexRef) Dir() string {
@@ -90,7 +206,7 @@ func (r *IndexRef) Dir() string {
 }
 
 func (r *IndexRef) writeManifest() error {
-	w, err := os.Create(filepath.Join(r.dir, manifestFilename))
+	w, err := r.fs.Create(filepath.Join(r.dir, manifestFilename))
 	if err != nil {
 		return err
 	}
@@ -99,15 +215,26 @@ func (r *IndexRef) writeManifest() error {
 	return gob.NewEncoder(w).Encode(r)
 }
 
-func (r *IndexRef) Open() (*Index, error) {
+// Open opens the index in r.Dir() for searching, reading raw/ blobs and the
+// manifest through fs (nil defaults to the OS filesystem).
+func (r *IndexRef) Open(fs afero.Fs) (*Index, error) {
+	r.fs = resolveFS(fs)
 	return &Index{
 		Ref: r,
 		idx: index.Open(filepath.Join(r.dir, "tri")),
 	}, nil
 }
 
+// Remove deletes the index directory. raw/, the manifest, and
+// excluded_files.json go through r.fs, but the trigram index (the "tri"
+// directory) is always written directly to local disk regardless of
+// IndexOptions.FS, so it's removed separately here; otherwise plugging in a
+// non-OS FS would leave it behind forever.
 func (r *IndexRef) Remove() error {
-	return os.RemoveAll(r.dir)
+	if err := os.RemoveAll(filepath.Join(r.dir, "tri")); err != nil {
+		return err
+	}
+	return r.fs.RemoveAll(r.dir)
 }
 
 func (n *Index) Close() error {
@@ -138,6 +265,77 @@ func toStrings(lines [][]byte) []string {
 	return strs
 }
 
+// openRawFile opens the gzipped raw/ blob for name through n.Ref.fs and
+// returns a reader over its decompressed contents.
+func (n *Index) openRawFile(name string) (io.ReadCloser, error) {
+	f, err := n.Ref.fs.Open(filepath.Join(n.Ref.dir, "raw", name))
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &gzipRawFile{gz: gz, f: f}, nil
+}
+
+// gzipRawFile closes both the gzip stream and the underlying afero.File it
+// wraps.
+type gzipRawFile struct {
+	gz *gzip.Reader
+	f  afero.File
+}
+
+func (g *gzipRawFile) Read(p []byte) (int, error) { return g.gz.Read(p) }
+
+func (g *gzipRawFile) Close() error {
+	gzErr := g.gz.Close()
+	fErr := g.f.Close()
+	if gzErr != nil {
+		return gzErr
+	}
+	return fErr
+}
+
+// grepReader scans r line by line for matches of re, invoking fn for each
+// match with up to context lines of surrounding text. It plays the same role
+// grep2File used to play against a fixed on-disk path, but works against any
+// io.Reader so Search can source raw/ contents through IndexOptions.FS.
+func grepReader(r io.Reader, re *regexp.Regexp, context int, fn func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var lines [][]byte
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i, line := range lines {
+		if re.MatchString(string(line), true, true) < 0 {
+			continue
+		}
+
+		before := lines[max(0, i-context):i]
+		after := lines[i+1 : min(len(lines), i+1+context)]
+
+		cont, err := fn(line, i+1, before, after)
+		if err != nil {
+			return err
+		}
+		if !cont {
+			return nil
+		}
+	}
+
+	return nil
+}
+
 // GetRegexpPattern ...
 func GetRegexpPattern(pat string, ignoreCase bool) string {
 	if ignoreCase {
@@ -159,7 +357,6 @@ func (n *Index) Search(pat, slug string, opt *SearchOptions) (*SearchResponse, e
 	}
 
 	var (
-		g                grepper
 		results          []*FileMatch
 		filesOpened      int
 		filesFound       int
@@ -176,18 +373,57 @@ func (n *Index) Search(pat, slug string, opt *SearchOptions) (*SearchResponse, e
 	}
 
 	files := n.idx.PostingQuery(index.RegexpQuery(re.Syntax))
+
+	type candidate struct {
+		name string
+	}
+
+	candidates := make([]candidate, 0, len(files))
 	for _, file := range files {
-		var matches []*Match
 		name := n.idx.Name(file)
-		hasMatch := false
 
 		// reject files that do not match the file pattern
 		if fre != nil && fre.MatchString(name, true, true) < 0 {
 			continue
 		}
 
+		candidates = append(candidates, candidate{name: name})
+	}
+
+	// Sort candidates up front so Offset/Limit select a stable, well-defined
+	// slice of them and we can stop opening raw/ blobs as soon as that slice
+	// is full, without having to look at the rest.
+	switch opt.OrderBy {
+	case OrderByMatchCount:
+		sort.Slice(candidates, func(i, j int) bool {
+			ti, tj := n.Ref.TrigramCounts[candidates[i].name], n.Ref.TrigramCounts[candidates[j].name]
+			if ti != tj {
+				return ti > tj
+			}
+			return candidates[i].name < candidates[j].name
+		})
+	default:
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].name < candidates[j].name
+		})
+	}
+
+	for _, c := range candidates {
+		if opt.Limit > 0 && filesFound >= opt.Offset+opt.Limit {
+			break
+		}
+
+		var matches []*Match
+		name := c.name
+		hasMatch := false
+
 		filesOpened++
-		if err := g.grep2File(filepath.Join(n.Ref.dir, "raw", name), re, int(opt.LinesOfContext),
+		raw, err := n.openRawFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = grepReader(raw, re, int(opt.LinesOfContext),
 			func(line []byte, lineno int, before [][]byte, after [][]byte) (bool, error) {
 
 				hasMatch = true
@@ -208,7 +444,9 @@ func (n *Index) Search(pat, slug string, opt *SearchOptions) (*SearchResponse, e
 				}
 
 				return true, nil
-			}); err != nil {
+			})
+		raw.Close()
+		if err != nil {
 			return nil, err
 		}
 
@@ -323,8 +561,8 @@ func validUTF8IgnoringPartialTrailingRune(p []byte) bool {
 }
 
 // write the list of excluded files to the given filename.
-func writeExcludedFilesJSON(filename string, files []*ExcludedFile) error {
-	w, err := os.Create(filename)
+func writeExcludedFilesJSON(fs afero.Fs, filename string, files []*ExcludedFile) error {
+	w, err := fs.Create(filename)
 	if err != nil {
 		return err
 	}
@@ -342,16 +580,93 @@ func containsString(haystack []string, needle string) bool {
 	return false
 }
 
-// Read the metadata for the index directory. Note that even if this
-// returns a non-nil error, a Metadata object will be returned with
-// all the information that is known about the index (this might
-// include only the path)
-func Read(dir string) (*IndexRef, error) {
+// safeZipEntryPath reports whether name is safe to extract under dst/raw: not
+// an absolute path, and its cleaned form doesn't climb out of the archive
+// root via "..". A crafted file.Name like "../../etc/passwd" would otherwise
+// let a hostile ZIP write outside dst.
+func safeZipEntryPath(name string) bool {
+	if name == "" || filepath.IsAbs(name) {
+		return false
+	}
+
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	return true
+}
+
+// guardZipFile applies IndexOptions' resource-limit guards to a non-directory
+// entry, using only its central directory metadata so hostile size/ratio
+// claims are caught before anything is decompressed. total tracks the
+// running uncompressed-byte count admitted so far for the whole archive and
+// is updated in place. It returns a non-empty exclusion reason if file should
+// be skipped.
+func guardZipFile(opt *IndexOptions, file *zip.File, total *int64) string {
+	info := file.FileInfo()
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return reasonSymlink
+	case info.Mode()&os.ModeDevice != 0:
+		return reasonDevice
+	case info.Mode()&os.ModeType != 0:
+		return reasonInvalidMode
+	}
+
+	if opt.MaxFileSize > 0 && int64(file.UncompressedSize64) > opt.MaxFileSize {
+		return reasonTooLarge
+	}
+
+	if opt.MaxCompressionRatio > 0 && file.CompressedSize64 > 0 {
+		ratio := float64(file.UncompressedSize64) / float64(file.CompressedSize64)
+		if ratio > opt.MaxCompressionRatio {
+			return reasonZipBomb
+		}
+	}
+
+	if opt.MaxTotalUncompressed > 0 {
+		*total += int64(file.UncompressedSize64)
+		if *total > opt.MaxTotalUncompressed {
+			return reasonTotalTooLarge
+		}
+	}
+
+	return ""
+}
+
+// countTrigrams returns the number of distinct 3-byte trigrams in content,
+// the same unit codesearch's index is built from. It's a cheap proxy for how
+// much matching content a file is likely to hold, computed once at index
+// time and stored in IndexRef.TrigramCounts so Search can rank by it later
+// without reopening the file.
+func countTrigrams(content []byte) int {
+	if len(content) < 3 {
+		return 0
+	}
+
+	seen := make(map[uint32]struct{})
+	for i := 0; i+3 <= len(content); i++ {
+		t := uint32(content[i])<<16 | uint32(content[i+1])<<8 | uint32(content[i+2])
+		seen[t] = struct{}{}
+	}
+
+	return len(seen)
+}
+
+// Read the metadata for the index directory, via fs (nil defaults to the OS
+// filesystem). Note that even if this returns a non-nil error, a Metadata
+// object will be returned with all the information that is known about the
+// index (this might include only the path)
+func Read(fs afero.Fs, dir string) (*IndexRef, error) {
+	fs = resolveFS(fs)
 	m := &IndexRef{
 		dir: dir,
+		fs:  fs,
 	}
 
-	r, err := os.Open(filepath.Join(dir, manifestFilename))
+	r, err := fs.Open(filepath.Join(dir, manifestFilename))
 	if err != nil {
 		return m, err
 	}
@@ -364,69 +679,189 @@ func Read(dir string) (*IndexRef, error) {
 	return m, nil
 }
 
-// Open the index in dir for searching.
-func Open(dir string) (*Index, error) {
-	r, err := Read(dir)
+// Open the index in dir for searching, via fs (nil defaults to the OS
+// filesystem).
+func Open(fs afero.Fs, dir string) (*Index, error) {
+	r, err := Read(fs, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	return r.Open()
+	return r.Open(fs)
 }
 
-// BuildFromZip ...
+// BuildFromZip builds an index from archive, an in-memory ZIP file. It is a
+// thin wrapper around BuildFromZipReader kept for backward compatibility;
+// prefer BuildFromZipReader or BuildFromZipStream when the archive doesn't
+// already need to be resident in memory, since the WordPress directory hosts
+// plugin and theme ZIPs that can run into the hundreds of megabytes.
 func BuildFromZip(opt *IndexOptions, archive []byte, dst, slug string) (*IndexRef, *filestats.Stats, error) {
+	return BuildFromZipReader(opt, bytes.NewReader(archive), int64(len(archive)), dst, slug)
+}
 
-	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+// BuildFromZipReader builds an index from r, a ZIP archive of the given
+// size. Unlike BuildFromZip, the archive never has to be buffered into a
+// single []byte up front; r is read directly by archive/zip, so an *os.File
+// can be indexed without ever holding the whole ZIP in memory.
+func BuildFromZipReader(opt *IndexOptions, r io.ReaderAt, size int64, dst, slug string) (*IndexRef, *filestats.Stats, error) {
+	zr, err := zip.NewReader(r, size)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if err := os.Mkdir(dst, os.ModePerm); err != nil {
+	fs := resolveFS(opt.FS)
+
+	if err := fs.Mkdir(dst, os.ModePerm); err != nil {
 		return nil, nil, err
 	}
 
-	if err := os.Mkdir(filepath.Join(dst, "raw"), os.ModePerm); err != nil {
+	if err := fs.Mkdir(filepath.Join(dst, "raw"), os.ModePerm); err != nil {
 		return nil, nil, err
 	}
 
-	stats, err := indexAllZipFiles(opt, dst, zr.File)
+	stats, fingerprints, trigramCounts, err := indexAllZipFiles(opt, fs, dst, zr.File)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	r := &IndexRef{
-		Time: time.Now(),
-		dir:  dst,
-		Slug: slug,
+	ref := &IndexRef{
+		Time:             time.Now(),
+		dir:              dst,
+		Slug:             slug,
+		FallbackEncoding: opt.FallbackEncoding,
+		Fingerprints:     fingerprints,
+		TrigramCounts:    trigramCounts,
+		fs:               fs,
 	}
 
-	if err := r.writeManifest(); err != nil {
+	if err := ref.writeManifest(); err != nil {
 		return nil, nil, err
 	}
 
-	return r, stats, nil
+	return ref, stats, nil
 }
 
-func indexAllZipFiles(opt *IndexOptions, dst string, zfiles []*zip.File) (*filestats.Stats, error) {
-	ix := index.Create(filepath.Join(dst, "tri"))
-	defer ix.Close()
+// BuildFromZipStream builds an index from r, a ZIP archive read as a plain
+// stream. archive/zip needs to seek to the trailing central directory, so r
+// is teed to a temp file on opt.FS as it's read; the temp file is then
+// handed to BuildFromZipReader and removed once indexing finishes.
+func BuildFromZipStream(opt *IndexOptions, r io.Reader, dst, slug string) (*IndexRef, *filestats.Stats, error) {
+	fs := resolveFS(opt.FS)
 
-	excluded := []*ExcludedFile{}
+	tmp, err := afero.TempFile(fs, "", "wpdir-zip-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fs.Remove(tmp.Name())
+	defer tmp.Close()
 
-	// Make a file to store the excluded files for this repo
-	fileHandle, err := os.Create(filepath.Join(dst, "excluded_files.json"))
+	size, err := io.Copy(tmp, r)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	return BuildFromZipReader(opt, tmp, size, dst, slug)
+}
+
+// Update incrementally re-indexes n against archive: files whose CRC32 and
+// size match n.Ref.Fingerprints keep their existing raw/ blob and trigram
+// postings, only new or changed files are re-tokenized, and files no longer
+// present in archive are pruned. It rebuilds n's index in place and is a
+// thin wrapper around BuildFromZipIncremental using n.Ref as the baseline.
+// This is the common case for a plugin point release that only touches a
+// handful of files, so it's far cheaper than a full BuildFromZip.
+func (n *Index) Update(opt *IndexOptions, archive []byte) (*IndexRef, *filestats.Stats, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	ref, stats, err := BuildFromZipIncremental(opt, archive, n.Ref.dir, n.Ref.Slug, n.Ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := n.idx.Close(); err != nil {
+		return nil, nil, err
+	}
+	n.idx = index.Open(filepath.Join(ref.dir, "tri"))
+	n.Ref = ref
+
+	return ref, stats, nil
+}
+
+// BuildFromZipIncremental builds an index at dst from archive, reusing
+// prev's raw/ blobs and trigram postings for any file whose CRC32 and size
+// match prev.Fingerprints. Only new or modified files are read from archive
+// and re-tokenized; files recorded in prev.Fingerprints but absent from
+// archive are dropped. If prev is nil or has no fingerprints to compare
+// against, this falls back to a full BuildFromZip.
+func BuildFromZipIncremental(opt *IndexOptions, archive []byte, dst, slug string, prev *IndexRef) (*IndexRef, *filestats.Stats, error) {
+	if prev == nil || len(prev.Fingerprints) == 0 {
+		return BuildFromZip(opt, archive, dst, slug)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs := resolveFS(opt.FS)
+
+	if dst != prev.dir {
+		if err := fs.Mkdir(dst, os.ModePerm); err != nil {
+			return nil, nil, err
+		}
+		if err := fs.Mkdir(filepath.Join(dst, "raw"), os.ModePerm); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	stats, fingerprints, trigramCounts, err := indexAllZipFilesIncremental(opt, fs, dst, zr.File, prev)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ref := &IndexRef{
+		Time:             time.Now(),
+		dir:              dst,
+		Slug:             slug,
+		FallbackEncoding: opt.FallbackEncoding,
+		Fingerprints:     fingerprints,
+		TrigramCounts:    trigramCounts,
+		fs:               fs,
+	}
+
+	if err := ref.writeManifest(); err != nil {
+		return nil, nil, err
+	}
+
+	return ref, stats, nil
+}
+
+func indexAllZipFilesIncremental(opt *IndexOptions, fs afero.Fs, dst string, zfiles []*zip.File, prev *IndexRef) (*filestats.Stats, map[string]fileFingerprint, map[string]int, error) {
+	fallback, err := resolveFallbackEncoding(opt.FallbackEncoding)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	defer fileHandle.Close()
 
-	processFile := func(name string, file *zip.File) error {
+	excluded := []*ExcludedFile{}
+	fingerprints := make(map[string]fileFingerprint)
+	trigramCounts := make(map[string]int)
+
+	var changed, unchanged []*zip.File
+	var totalUncompressed int64
+
+	classify := func(name string, file *zip.File) error {
 		info := file.FileInfo()
 		path := filepath.Dir(name)
 
-		// Is this file considered "special", this means it's not even a part
-		// of the source repository (like .git or .svn).
+		if !safeZipEntryPath(name) {
+			excluded = append(excluded, &ExcludedFile{
+				name,
+				reasonPathTraversal,
+			})
+			return nil
+		}
+
 		if containsString(opt.SpecialFiles, name) {
 			if info.IsDir() {
 				return filepath.SkipDir
@@ -447,104 +882,495 @@ func indexAllZipFiles(opt *IndexOptions, dst string, zfiles []*zip.File) (*files
 		}
 
 		if info.IsDir() {
-			return addZipDirToIndex(dst, name, path)
+			return addZipDirToIndex(fs, dst, name, path)
 		}
 
-		if info.Mode()&os.ModeType != 0 {
+		if reason := guardZipFile(opt, file, &totalUncompressed); reason != "" {
 			excluded = append(excluded, &ExcludedFile{
 				name,
-				reasonInvalidMode,
+				reason,
 			})
 			return nil
 		}
 
-		txt, err := isZipTextFile(file)
+		fp := fileFingerprint{CRC32: file.CRC32, Size: file.UncompressedSize64}
+		if prevFp, ok := prev.Fingerprints[name]; ok && prevFp == fp {
+			unchanged = append(unchanged, file)
+		} else {
+			changed = append(changed, file)
+		}
+		return nil
+	}
+
+	stats := filestats.New()
+	for _, file := range zfiles {
+		if err := classify(file.Name, file); err != nil {
+			return nil, nil, nil, err
+		}
+		stats.AddFile(file)
+	}
+	stats.GenerateSummary()
+
+	carriedPath := filepath.Join(dst, "tri.carried")
+	deltaPath := filepath.Join(dst, "tri.delta")
+	mergedPath := filepath.Join(dst, "tri.merged")
+
+	// These are scratch directories for this call only; clean them up on
+	// every exit, success or failure, so a transient error (a bad ZIP entry,
+	// a merge failure, ...) can't leave stale contents behind to confuse the
+	// next Update/BuildFromZipIncremental call that reuses the same dst.
+	defer os.RemoveAll(carriedPath)
+	defer os.RemoveAll(deltaPath)
+	defer os.RemoveAll(mergedPath)
+
+	carriedIx := index.Create(carriedPath)
+	for _, file := range unchanged {
+		if err := carryForwardFile(prev, fs, dst, carriedIx, file.Name); err != nil {
+			carriedIx.Close()
+			return nil, nil, nil, err
+		}
+		fingerprints[file.Name] = prev.Fingerprints[file.Name]
+		trigramCounts[file.Name] = prev.TrigramCounts[file.Name]
+	}
+	carriedIx.Flush()
+	carriedIx.Close()
+
+	deltaIx := index.Create(deltaPath)
+	if err := indexFilesConcurrently(fs, dst, fallback, deltaIx, changed, &excluded, fingerprints, trigramCounts); err != nil {
+		deltaIx.Close()
+		return nil, nil, nil, err
+	}
+	deltaIx.Flush()
+	deltaIx.Close()
+
+	if err := index.Merge(mergedPath, carriedPath, deltaPath); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Swap the merged index in for the live one via a rename-old-to-backup,
+	// rename-new-to-live, remove-backup sequence, rather than removing the
+	// live tri/ outright before the rename: if the second rename fails (a
+	// cross-device move, a permission error, disk full, ...), the backup is
+	// renamed back into place so Search keeps working against the old
+	// index instead of finding none at all.
+	triPath := filepath.Join(dst, "tri")
+	triBackupPath := filepath.Join(dst, "tri.bak")
+
+	if err := os.RemoveAll(triBackupPath); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := os.Rename(triPath, triBackupPath); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := os.Rename(mergedPath, triPath); err != nil {
+		os.Rename(triBackupPath, triPath)
+		return nil, nil, nil, err
+	}
+	os.RemoveAll(triBackupPath)
+
+	// Prune raw/ blobs for files that were indexed previously but didn't end
+	// up in the new fingerprints, whether because they were removed from
+	// archive or because they were excluded on this pass (e.g. they no
+	// longer decode as text). Checking fingerprints directly, rather than a
+	// separately tracked "seen" set, means a file can only escape pruning by
+	// actually being carried forward or successfully re-indexed.
+	for name := range prev.Fingerprints {
+		if _, ok := fingerprints[name]; !ok {
+			fs.Remove(filepath.Join(dst, "raw", name))
+		}
+	}
+
+	if err := writeExcludedFilesJSON(fs, filepath.Join(dst, excludedFileJSONFilename), excluded); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return stats, fingerprints, trigramCounts, nil
+}
+
+// carryForwardFile re-adds name's existing content (read back from prev's
+// raw/ blob) to ix, without re-reading it from the ZIP or re-running
+// text-detection/transcoding. If dst differs from prev's directory, the
+// blob is also copied over to dst so the new index has its own raw/ copy.
+func carryForwardFile(prev *IndexRef, fs afero.Fs, dst string, ix *index.IndexWriter, name string) error {
+	src, err := prev.fs.Open(filepath.Join(prev.dir, "raw", name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(gz)
+	gz.Close()
+	if err != nil {
+		return err
+	}
+
+	if dst != prev.dir {
+		w, err := fs.Create(filepath.Join(dst, "raw", name))
 		if err != nil {
 			return err
 		}
 
-		if !txt {
+		gw := gzip.NewWriter(w)
+		if _, err := gw.Write(content); err != nil {
+			gw.Close()
+			w.Close()
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+
+	ix.Add(name, bytes.NewReader(content))
+	return nil
+}
+
+func indexAllZipFiles(opt *IndexOptions, fs afero.Fs, dst string, zfiles []*zip.File) (*filestats.Stats, map[string]fileFingerprint, map[string]int, error) {
+	ix := index.Create(filepath.Join(dst, "tri"))
+	defer ix.Close()
+
+	fallback, err := resolveFallbackEncoding(opt.FallbackEncoding)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	excluded := []*ExcludedFile{}
+
+	var toIndex []*zip.File
+	var totalUncompressed int64
+
+	// classify handles directories and the cheap, order-sensitive exclusion
+	// checks in place; regular files are deferred to toIndex so the
+	// expensive text-detection/gzip work can run concurrently below.
+	classify := func(name string, file *zip.File) error {
+		info := file.FileInfo()
+		path := filepath.Dir(name)
+
+		if !safeZipEntryPath(name) {
 			excluded = append(excluded, &ExcludedFile{
 				name,
-				reasonNotText,
+				reasonPathTraversal,
 			})
 			return nil
 		}
 
-		reasonForExclusion, err := addZipFileToIndex(ix, dst, name, path, file)
-		if err != nil {
-			return err
+		// Is this file considered "special", this means it's not even a part
+		// of the source repository (like .git or .svn).
+		if containsString(opt.SpecialFiles, name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if reasonForExclusion != "" {
-			excluded = append(excluded, &ExcludedFile{name, reasonForExclusion})
+
+		if opt.ExcludeDotFiles && name[0] == '.' {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			excluded = append(excluded, &ExcludedFile{
+				name,
+				reasonDotFile,
+			})
+			return nil
 		}
 
+		if info.IsDir() {
+			return addZipDirToIndex(fs, dst, name, path)
+		}
+
+		if reason := guardZipFile(opt, file, &totalUncompressed); reason != "" {
+			excluded = append(excluded, &ExcludedFile{
+				name,
+				reason,
+			})
+			return nil
+		}
+
+		toIndex = append(toIndex, file)
 		return nil
 	}
 
 	stats := filestats.New()
 	for _, file := range zfiles {
-		if err = processFile(file.Name, file); err != nil {
-			return nil, err
+		if err = classify(file.Name, file); err != nil {
+			return nil, nil, nil, err
 		}
 		stats.AddFile(file)
 	}
 	stats.GenerateSummary()
 
-	if err := writeExcludedFilesJSON(filepath.Join(dst, excludedFileJSONFilename), excluded); err != nil {
-		return nil, err
+	fingerprints := make(map[string]fileFingerprint)
+	trigramCounts := make(map[string]int)
+	if err := indexFilesConcurrently(fs, dst, fallback, ix, toIndex, &excluded, fingerprints, trigramCounts); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := writeExcludedFilesJSON(fs, filepath.Join(dst, excludedFileJSONFilename), excluded); err != nil {
+		return nil, nil, nil, err
 	}
 
 	ix.Flush()
 
-	return stats, nil
+	return stats, fingerprints, trigramCounts, nil
+}
+
+// maxIndexWorkers bounds the worker pool indexFilesConcurrently spins up, so
+// indexing a ZIP with tens of thousands of entries doesn't spawn a similar
+// number of goroutines all opening files at once.
+const maxIndexWorkers = 8
+
+func indexWorkerCount(n int) int {
+	workers := runtime.NumCPU()
+	if workers > maxIndexWorkers {
+		workers = maxIndexWorkers
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+type zipFileResult struct {
+	name     string
+	content  []byte
+	reason   string
+	crc32    uint32
+	size     uint64
+	trigrams int
+}
+
+// indexFilesConcurrently prepares each of files (text-detection, optional
+// transcoding, and gzip-compressing it into raw/) across a bounded worker
+// pool, so that I/O-bound per-file work overlaps. Results stream back over a
+// channel to this function's own loop, which is the single point that calls
+// ix.Add and appends to excluded, since IndexWriter isn't safe for
+// concurrent use. fingerprints and trigramCounts, if non-nil, are filled in
+// with the CRC32/size and trigram count of every file that's actually added
+// to ix.
+func indexFilesConcurrently(fs afero.Fs, dst string, fallback encoding.Encoding, ix *index.IndexWriter, files []*zip.File, excluded *[]*ExcludedFile, fingerprints map[string]fileFingerprint, trigramCounts map[string]int) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	jobs := make(chan *zip.File)
+	results := make(chan zipFileResult)
+	errc := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	workers := indexWorkerCount(len(files))
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				content, reason, err := prepareZipFile(fs, dst, fallback, file)
+				if err != nil {
+					select {
+					case errc <- err:
+					default:
+					}
+					continue
+				}
+				trigrams := 0
+				if reason == "" {
+					trigrams = countTrigrams(content)
+				}
+				results <- zipFileResult{
+					name:     file.Name,
+					content:  content,
+					reason:   reason,
+					crc32:    file.CRC32,
+					size:     file.UncompressedSize64,
+					trigrams: trigrams,
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, file := range files {
+			jobs <- file
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		if res.reason != "" {
+			*excluded = append(*excluded, &ExcludedFile{res.name, res.reason})
+			continue
+		}
+		if reason := ix.Add(res.name, bytes.NewReader(res.content)); reason != "" {
+			*excluded = append(*excluded, &ExcludedFile{res.name, reason})
+			continue
+		}
+		if fingerprints != nil {
+			fingerprints[res.name] = fileFingerprint{CRC32: res.crc32, Size: res.size}
+		}
+		if trigramCounts != nil {
+			trigramCounts[res.name] = res.trigrams
+		}
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
 }
 
-func addZipFileToIndex(ix *index.IndexWriter, dst, src, path string, file *zip.File) (string, error) {
+// prepareZipFile reads a single zip entry, transcoding it through fallback
+// if isZipTextFile determined that's required, and gzip-writes it into
+// raw/. It returns the (possibly transcoded) content so the caller can feed
+// it to IndexWriter.Add, or a non-empty reason if the file should be
+// excluded instead.
+func prepareZipFile(fs afero.Fs, dst string, fallback encoding.Encoding, file *zip.File) ([]byte, string, error) {
+	txt, transcode, err := isZipTextFile(file, fallback)
+	if err != nil {
+		return nil, "", err
+	}
+	if !txt {
+		return nil, reasonNotText, nil
+	}
+
 	r, err := file.Open()
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 	defer r.Close()
 
+	// raw/ and the trigram index both store the transcoded UTF-8 form, so
+	// Search regexps operate on consistent text regardless of source encoding.
+	var src io.Reader = r
+	if transcode {
+		src = fallback.NewDecoder().Reader(r)
+	}
+
+	content, err := io.ReadAll(src)
+	if err != nil {
+		return nil, "", err
+	}
+
 	dup := filepath.Join(dst, "raw", file.Name)
-	w, err := os.Create(dup)
+	w, err := fs.Create(dup)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 	defer w.Close()
 
 	g := gzip.NewWriter(w)
-	defer g.Close()
+	if _, err := g.Write(content); err != nil {
+		g.Close()
+		return nil, "", err
+	}
+	if err := g.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return content, "", nil
+}
 
-	return ix.Add(file.Name, io.TeeReader(r, g)), nil
+// resolveFallbackEncoding looks up name (e.g. "shift_jis", "euc-kr",
+// "windows-1252", "iso-8859-1") via golang.org/x/text/encoding/htmlindex. An
+// empty name disables fallback decoding and returns a nil encoding.
+func resolveFallbackEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return htmlindex.Get(name)
 }
 
-func isZipTextFile(file *zip.File) (bool, error) {
+// isZipTextFile reports whether file looks like text. It first checks the
+// raw bytes for valid UTF-8; if that fails and fallback is non-nil, it
+// reports whether fallback can decode the whole file cleanly. The second
+// return value indicates whether the fallback encoding was what made the
+// file pass, so callers know whether to transcode when indexing it.
+func isZipTextFile(file *zip.File, fallback encoding.Encoding) (bool, bool, error) {
 	buf := make([]byte, filePeekSize)
 	r, err := file.Open()
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 	defer r.Close()
 
 	n, err := io.ReadFull(r, buf)
 	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
-		return false, err
+		return false, false, err
 	}
 
 	buf = buf[:n]
 
+	var valid bool
 	if n < filePeekSize {
 		// read the whole file, must be valid.
-		return utf8.Valid(buf), nil
+		valid = utf8.Valid(buf)
+	} else {
+		// read a prefix, allow trailing partial runes.
+		valid = validUTF8IgnoringPartialTrailingRune(buf)
+	}
+
+	if valid || fallback == nil {
+		return valid, false, nil
+	}
+
+	ok, err := fallbackDecodesCleanly(file, fallback)
+	if err != nil {
+		return false, false, err
+	}
+
+	return ok, ok, nil
+}
+
+// fallbackDecodesCleanly reports whether enc can decode the entirety of
+// file's contents without error, and whether a peek-sized prefix of the
+// decoded bytes looks like text rather than binary. Single-byte legacy
+// encodings like windows-1252 and iso-8859-1 assign a character to almost
+// every byte value, so a clean decode alone would accept binary formats
+// (images, compiled .so/.phar, fonts, ...) that happen to fail the UTF-8
+// check; running detectBinary over the decoded prefix catches those the
+// same way isBinaryFile does on the UTF-8 path.
+func fallbackDecodesCleanly(file *zip.File, enc encoding.Encoding) (bool, error) {
+	r, err := file.Open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	dec := enc.NewDecoder().Reader(r)
+
+	peek := make([]byte, filePeekSize)
+	n, err := io.ReadFull(dec, peek)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, nil
+	}
+	peek = peek[:n]
+
+	if detectBinary(peek) {
+		return false, nil
+	}
+
+	if _, err := io.Copy(io.Discard, dec); err != nil {
+		return false, nil
 	}
 
-	// read a prefix, allow trailing partial runes.
-	return validUTF8IgnoringPartialTrailingRune(buf), nil
+	return true, nil
 }
 
-func addZipDirToIndex(dst, src, path string) error {
+func addZipDirToIndex(fs afero.Fs, dst, src, path string) error {
 	dup := filepath.Join(dst, "raw", path)
-	return os.Mkdir(dup, 0766)
+	return fs.Mkdir(dup, 0766)
 }
@@ -0,0 +1,112 @@
+package index
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchOrderByFilenameIsDefaultAndStable(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "idx")
+	opt := &IndexOptions{}
+
+	ref, _, err := BuildFromZip(opt, buildZip(t, map[string]string{
+		"b.txt": "needle",
+		"a.txt": "needle",
+		"c.txt": "needle",
+	}), dst, "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ref.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	resp, err := n.Search("needle", "plugin", &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.txt", "b.txt", "c.txt"}
+	if len(resp.Matches) != len(want) {
+		t.Fatalf("expected %d matches, got %d", len(want), len(resp.Matches))
+	}
+	for i, name := range want {
+		if resp.Matches[i].Filename != name {
+			t.Fatalf("match %d: expected %s, got %s", i, name, resp.Matches[i].Filename)
+		}
+	}
+}
+
+func TestSearchOrderByMatchCountRanksByTrigramCount(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "idx")
+	opt := &IndexOptions{}
+
+	ref, _, err := BuildFromZip(opt, buildZip(t, map[string]string{
+		"small.txt":  "needle\n",
+		"medium.txt": "needle plus a little more content than small.txt has\n",
+		"large.txt":  "needle needle needle, and lots of other padding words to give this file many more distinct trigrams than either of the other two\n",
+	}), dst, "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ref.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	resp, err := n.Search("needle", "plugin", &SearchOptions{OrderBy: OrderByMatchCount})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Matches) != 3 {
+		t.Fatalf("expected 3 matching files, got %d", len(resp.Matches))
+	}
+
+	for i := 1; i < len(resp.Matches); i++ {
+		prev := n.Ref.TrigramCounts[resp.Matches[i-1].Filename]
+		cur := n.Ref.TrigramCounts[resp.Matches[i].Filename]
+		if prev < cur {
+			t.Fatalf("expected non-increasing trigram counts, got %d (%s) before %d (%s)",
+				prev, resp.Matches[i-1].Filename, cur, resp.Matches[i].Filename)
+		}
+	}
+}
+
+func TestSearchLimitStopsScanningEarly(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "idx")
+	opt := &IndexOptions{}
+
+	ref, _, err := BuildFromZip(opt, buildZip(t, map[string]string{
+		"a.txt": "needle",
+		"b.txt": "needle",
+		"c.txt": "needle",
+		"d.txt": "needle",
+	}), dst, "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ref.Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	resp, err := n.Search("needle", "plugin", &SearchOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.FilesWithMatch > 2 {
+		t.Fatalf("expected the scan to stop once 2 matching files were found, FilesWithMatch = %d", resp.FilesWithMatch)
+	}
+	if len(resp.Matches) != 2 {
+		t.Fatalf("expected 2 matches within the limit, got %d", len(resp.Matches))
+	}
+}
@@ -0,0 +1,56 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzBuildFromZip seeds from the standard library's archive/zip regression
+// corpus (a stray CRC32, data-descriptor-only entries, duplicate directory
+// entries, a symlink entry, and a trailing-junk EOCD) and fuzzes BuildFromZip
+// against mutations of them. It only asserts what chunk0-5's guards promise:
+// no panic, no entry written outside dst/raw, and every indexed entry has a
+// corresponding raw/ blob. It's not a correctness test for archive/zip
+// itself.
+func FuzzBuildFromZip(f *testing.F) {
+	for _, name := range []string{
+		"crc32-not-streamed.zip",
+		"dd.zip",
+		"dupdir.zip",
+		"symlink.zip",
+		"trailing-junk.zip",
+	} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	opt := &IndexOptions{
+		MaxFileSize:          1 << 20,
+		MaxTotalUncompressed: 1 << 22,
+		MaxCompressionRatio:  1000,
+	}
+
+	f.Fuzz(func(t *testing.T, archive []byte) {
+		dst := filepath.Join(t.TempDir(), "idx")
+
+		ref, _, err := BuildFromZip(opt, archive, dst, "fuzz")
+		if err != nil {
+			// Malformed/hostile input is expected to be rejected, not to panic.
+			return
+		}
+		defer ref.Remove()
+
+		for name := range ref.Fingerprints {
+			if !safeZipEntryPath(name) {
+				t.Fatalf("indexed entry escaped the archive root: %q", name)
+			}
+			if _, err := os.Stat(filepath.Join(dst, "raw", name)); err != nil {
+				t.Fatalf("raw blob missing for indexed file %q: %v", name, err)
+			}
+		}
+	})
+}